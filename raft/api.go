@@ -0,0 +1,32 @@
+package raft
+
+// PublicRaftAPI exposes ProtocolManager's raft cluster state over RPC, for
+// registration under the "raft" namespace alongside the node's other public
+// APIs (see eth.Ethereum.APIs). This is what lets an operator run
+// `raft.leader`, `raft.cluster`, and `raft.state` from the JS console instead
+// of grepping logs for "BecameMinter".
+type PublicRaftAPI struct {
+	raftService *ProtocolManager
+}
+
+// NewPublicRaftAPI creates a new API definition for the raft services.
+func NewPublicRaftAPI(raftService *ProtocolManager) *PublicRaftAPI {
+	return &PublicRaftAPI{raftService}
+}
+
+// Leader returns the raftId of the node currently believed to be the leader
+// (and therefore the minter).
+func (api *PublicRaftAPI) Leader() (uint16, error) {
+	return api.raftService.RaftLeader()
+}
+
+// Cluster returns the currently-known raft peers, including learners.
+func (api *PublicRaftAPI) Cluster() []*Peer {
+	return api.raftService.RaftPeers()
+}
+
+// State returns the current raft term, applied/snapshot indices, ConfState,
+// per-peer replication progress, and proposal replay state.
+func (api *PublicRaftAPI) State() (*RaftStateData, error) {
+	return api.raftService.RaftState()
+}
@@ -0,0 +1,49 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func makeTestNodes(n int) []*discover.Node {
+	nodes := make([]*discover.Node, n)
+	for i := range nodes {
+		nodes[i] = &discover.Node{}
+	}
+	return nodes
+}
+
+func TestNewConsensusEngineRejectsHashicorpBackend(t *testing.T) {
+	manager := &ProtocolManager{}
+
+	if _, err := newConsensusEngine("hashicorp", manager); err == nil {
+		t.Error("expected the not-yet-functional hashicorp backend to be rejected, got no error")
+	}
+
+	if engine, err := newConsensusEngine("", manager); err != nil {
+		t.Errorf("expected the default backend to be accepted, got error: %v", err)
+	} else if _, ok := engine.(*etcdConsensusEngine); !ok {
+		t.Errorf("expected the default backend to be *etcdConsensusEngine, got %T", engine)
+	}
+
+	if _, err := newConsensusEngine("etcd", manager); err != nil {
+		t.Errorf(`expected "etcd" to be accepted, got error: %v`, err)
+	}
+}
+
+func TestValidateRestoreRaftId(t *testing.T) {
+	peers := makeTestNodes(3)
+
+	for _, newRaftId := range []uint16{1, 2, 3} {
+		if err := validateRestoreRaftId(newRaftId, peers); err != nil {
+			t.Errorf("expected raftId %v to be valid for %v peers, got error: %v", newRaftId, len(peers), err)
+		}
+	}
+
+	for _, newRaftId := range []uint16{0, 4} {
+		if err := validateRestoreRaftId(newRaftId, peers); err == nil {
+			t.Errorf("expected raftId %v to be rejected for %v peers, got no error", newRaftId, len(peers))
+		}
+	}
+}